@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apparmor解析CRI的ApparmorProfile字符串，并生成对应的
+// containerd.SpecOpts，用于在支持AppArmor的宿主机上为容器设置进程的
+// AppArmor profile，和seccomp的处理方式是同一种模式。
+package apparmor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ProfileRuntimeDefault对应CRI里的"runtime/default"，表示使用containerd
+	// 自带的默认profile（"cri-containerd.apparmor.d"）
+	ProfileRuntimeDefault = "runtime/default"
+	// ProfileNameUnconfined对应CRI里的"unconfined"，表示不对容器进程施加任何
+	// AppArmor限制
+	ProfileNameUnconfined = "unconfined"
+	// ProfileNamePrefix是"localhost/<name>"这种形式里的前缀，<name>是宿主机上
+	// 已经通过apparmor_parser加载好的profile的名字
+	ProfileNamePrefix = "localhost/"
+
+	// profilesPath是内核上报已加载AppArmor profile的位置
+	profilesPath = "/sys/kernel/security/apparmor/profiles"
+	// defaultProfileName是containerd自带默认profile在内核里注册的名字
+	defaultProfileName = "cri-containerd.apparmor.d"
+)
+
+// ParseProfile把CRI LinuxContainerSecurityContext.ApparmorProfile这种格式的
+// 字符串解析成实际要加载的profile名字。空字符串和ProfileRuntimeDefault都返回
+// 默认profile的名字，ProfileNameUnconfined原样返回，localhost/<name>返回
+// <name>，其他取值视为非法。
+func ParseProfile(profile string) (string, error) {
+	switch {
+	case profile == "" || profile == ProfileRuntimeDefault:
+		return defaultProfileName, nil
+	case profile == ProfileNameUnconfined:
+		return ProfileNameUnconfined, nil
+	case strings.HasPrefix(profile, ProfileNamePrefix):
+		name := strings.TrimPrefix(profile, ProfileNamePrefix)
+		if name == "" {
+			return "", fmt.Errorf("invalid AppArmor profile %q: empty profile name", profile)
+		}
+		return name, nil
+	default:
+		return "", fmt.Errorf("invalid AppArmor profile %q", profile)
+	}
+}
+
+// IsEnabled探测当前宿主机是否支持AppArmor，依据是LSM是否注册了
+// /sys/kernel/security/apparmor/profiles这个文件。在SELinux-only等没有
+// 打开AppArmor的发行版上，这个探测会返回false，后续GenerateSpecOpts对空、
+// runtime/default和unconfined这几种取值直接no-op，对其他取值返回错误。
+func IsEnabled() bool {
+	_, err := os.Stat(profilesPath)
+	return err == nil
+}
+
+// isLoaded检查名为name的profile是否已经通过apparmor_parser加载进内核
+func isLoaded(name string) (bool, error) {
+	f, err := os.Open(profilesPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %q: %v", profilesPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 每一行的格式形如"<name> (enforce)"或者"<name> (complain)"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[0] == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// GenerateSpecOpts根据CRI传入的profile字符串、AppArmor是否enable以及容器是否
+// privileged，生成设置AppArmor profile的containerd.SpecOpts。
+// privileged容器会跳过（no-op），和seccomp的处理逻辑保持一致。AppArmor未启用
+// 的宿主机上，profile为空、runtime/default或unconfined时同样no-op，显式请求
+// 了其他profile（如localhost/<name>）时返回错误。
+func GenerateSpecOpts(profile string, privileged, apparmorEnabled bool) (containerd.SpecOpts, error) {
+	if privileged {
+		// 特权容器不应用任何AppArmor限制，和seccomp对privileged容器的处理方式一致
+		return nil, nil
+	}
+	if !apparmorEnabled {
+		if profile != "" && profile != ProfileRuntimeDefault && profile != ProfileNameUnconfined {
+			return nil, fmt.Errorf("apparmor is not supported on this host, but a profile %q was explicitly requested", profile)
+		}
+		return nil, nil
+	}
+
+	name, err := ParseProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if name == ProfileNameUnconfined {
+		return nil, nil
+	}
+	loaded, err := isLoaded(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check AppArmor profile %q: %v", name, err)
+	}
+	if !loaded {
+		if name == defaultProfileName {
+			// containerd自带的默认profile是在容器启动时由containerd自己惰性
+			// 加载的，而不是预先通过apparmor_parser装进内核，所以在第一个
+			// 容器真正启动之前看到它未加载是正常情况，不应该因此让
+			// RunPodSandbox失败；只有显式通过localhost/<name>请求了一个具体
+			// profile、而这个profile确实没有被加载时，才应该报错。
+			return nil, nil
+		}
+		return nil, fmt.Errorf("AppArmor profile %q is not loaded", name)
+	}
+	return func(_ context.Context, _ *containerd.Client, _ *containers.Container, s *runtimespec.Spec) error {
+		g := generate.NewFromSpec(s)
+		g.SetProcessApparmorProfile(name)
+		return nil
+	}, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cgroups提供了一些检测宿主机cgroup层级类型（v1/v2）以及在两者之间
+// 转换资源限制参数的辅助函数
+package cgroups
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// unifiedMountpoint是cgroup v2统一层级的标准挂载点
+const unifiedMountpoint = "/sys/fs/cgroup"
+
+var (
+	unifiedOnce   sync.Once
+	unifiedResult bool
+)
+
+// IsUnifiedMode返回宿主机的cgroup层级是否运行在cgroup v2的unified模式下。
+// 检测方式是对unifiedMountpoint执行statfs，判断其文件系统类型是否为
+// unix.CGROUP2_SUPER_MAGIC，检测结果通过sync.Once缓存，进程生命周期内
+// 只会真正执行一次statfs系统调用。
+func IsUnifiedMode() bool {
+	unifiedOnce.Do(func() {
+		var st unix.Statfs_t
+		if err := unix.Statfs(unifiedMountpoint, &st); err != nil {
+			// statfs失败时保守地认为宿主机仍然是cgroup v1，避免在检测异常的
+			// 情况下错误地生成v2专属的spec字段
+			unifiedResult = false
+			return
+		}
+		unifiedResult = st.Type == unix.CGROUP2_SUPER_MAGIC
+	})
+	return unifiedResult
+}
+
+// CPUSharesToV2Weight将cgroup v1的cpu.shares（取值范围[2, 262144]）转换为
+// cgroup v2的cpu.weight（取值范围[1, 10000]），采用runc使用的线性映射公式。
+func CPUSharesToV2Weight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/apparmor"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/cgroups"
+)
+
+// applyContainerApparmorOpts把workload容器的LinuxContainerSecurityContext.
+// ApparmorProfile应用到容器spec上，是generateSandboxContainerSpec里AppArmor
+// 那段逻辑在容器维度上的对应实现：和sandbox不同，workload容器的
+// SecurityContext带有显式的ApparmorProfile字段（""/"runtime/default"/
+// "unconfined"/"localhost/<name>"），需要按照这个字段而不是固定使用
+// ProfileRuntimeDefault。CreateContainer在生成容器spec时调用这个函数。
+func (c *criContainerdService) applyContainerApparmorOpts(g *generate.Generator, securityContext *runtime.LinuxContainerSecurityContext) error {
+	apparmorSpecOpts, err := apparmor.GenerateSpecOpts(
+		securityContext.GetApparmorProfile(), securityContext.GetPrivileged(), c.apparmorEnabled)
+	if err != nil {
+		return fmt.Errorf("failed to generate apparmor spec opts: %v", err)
+	}
+	if apparmorSpecOpts != nil {
+		if err := apparmorSpecOpts(nil, nil, nil, g.Spec()); err != nil {
+			return fmt.Errorf("failed to apply apparmor spec opts: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyContainerResources把workload容器的LinuxContainerResources应用到g上，
+// 是generateSandboxContainerSpec里cgroup v2换算那段逻辑在容器维度上的对应
+// 实现：和sandbox固定写死一个CPU份额不同，workload容器的CPU份额、内存上限、
+// OOM score adj都来自CRI请求，cgroup v1下直接通过对应的Set*写进Linux.Resources，
+// cgroup v2下cpu.shares/memory.limit_in_bytes这两个knob不存在，需要换算成
+// cpu.weight/memory.max并写入resources.unified。
+func (c *criContainerdService) applyContainerResources(g *generate.Generator, resources *runtime.LinuxContainerResources) {
+	if resources == nil {
+		return
+	}
+	if cgroups.IsUnifiedMode() {
+		weight := cgroups.CPUSharesToV2Weight(uint64(resources.GetCpuShares()))
+		linuxResources := g.Spec().Linux.Resources
+		if linuxResources == nil {
+			linuxResources = &runtimespec.LinuxResources{}
+			g.Spec().Linux.Resources = linuxResources
+		}
+		if linuxResources.Unified == nil {
+			linuxResources.Unified = make(map[string]string)
+		}
+		linuxResources.Unified["cpu.weight"] = strconv.FormatUint(weight, 10)
+		if limit := resources.GetMemoryLimitInBytes(); limit > 0 {
+			linuxResources.Unified["memory.max"] = strconv.FormatInt(limit, 10)
+		}
+	} else {
+		g.SetLinuxResourcesCPUShares(uint64(resources.GetCpuShares()))
+		if limit := resources.GetMemoryLimitInBytes(); limit > 0 {
+			g.SetLinuxResourcesMemoryLimit(limit)
+		}
+	}
+	g.SetProcessOOMScoreAdj(int(resources.GetOomScoreAdj()))
+}
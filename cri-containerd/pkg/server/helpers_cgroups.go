@@ -0,0 +1,39 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"path/filepath"
+)
+
+// cgroupsPathPrefix是systemd cgroup driver使用的shim私有前缀，和runc的
+// systemd cgroup manager约定的"<slice>:<prefix>:<name>"格式保持一致
+const cgroupsPathPrefix = "cri-containerd"
+
+// getCgroupsPath根据cgroupParent和容器/sandbox的id生成runc/containerd-shim
+// 需要的cgroups path。systemdCgroup为true时，不论宿主机是cgroup v1还是v2，
+// 都使用"<slice>:cri-containerd:<id>"这种由systemd负责翻译成实际cgroup路径的
+// 表示法；systemdCgroup为false时走cgroupfs驱动，runc在v1下会把这个相对路径在
+// 每个controller的挂载点下分别创建一份同名目录，在v2下只有一棵统一层级，同样
+// 的相对路径直接对应这棵层级下的一个子目录——两种层级下都是同一个相对路径，
+// 不需要也不应该区分，否则只会在其中一种层级上多出一段无意义的绝对路径前缀。
+func getCgroupsPath(cgroupParent, id string, systemdCgroup bool) string {
+	if systemdCgroup {
+		return cgroupParent + ":" + cgroupsPathPrefix + ":" + id
+	}
+	return filepath.Join(cgroupParent, id)
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hostport实现了一个不依赖CNI portmap插件的hostport管理器，行为上
+// 模仿kubelet自带的hostport实现：维护一张(hostIP, hostPort, protocol) ->
+// podIP:containerPort的内存映射表，并通过两条独立的iptables chain
+// （CRI-HOSTPORTS、CRI-HOSTPORTS-MASQ）同步DNAT和hairpin MASQUERADE规则。
+// 这两条chain完全由本管理器自己声明和挂载，不依赖kube-proxy维护的
+// KUBE-POSTROUTING chain是否存在，这样即使集群使用的CNI插件没有实现
+// portmap、甚至没有运行kube-proxy，hostPort依然可以工作。
+package hostport
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// criHostportsChain是挂在nat表PREROUTING/OUTPUT下的独立chain，所有由本
+	// 管理器维护的DNAT规则都集中在这条chain里，方便整体同步和清理
+	criHostportsChain = "CRI-HOSTPORTS"
+	// criHostportsMasqChain是挂在nat表POSTROUTING下的独立chain，存放hairpin
+	// 场景下的MASQUERADE规则。单独声明这条chain而不是复用kube-proxy的
+	// KUBE-POSTROUTING，是因为后者既可能不存在（没有运行kube-proxy的集群），
+	// 也不是本管理器拥有、负责声明的chain，把规则写进一个iptables-restore
+	// 输入里没有声明过的chain会直接导致整条restore失败
+	criHostportsMasqChain = "CRI-HOSTPORTS-MASQ"
+)
+
+// PortMapping描述了一个sandbox请求的hostPort映射，语义上对应CRI
+// PortMapping加上这个sandbox所在的PodIP
+type PortMapping struct {
+	HostPort      int32
+	ContainerPort int32
+	Protocol      string
+	HostIP        string
+}
+
+// PodPortMapping是一个Pod全部hostPort映射的集合，是Manager.Add/Remove的入参
+type PodPortMapping struct {
+	// Name和Namespace只用于日志和iptables规则里的comment
+	Name         string
+	Namespace    string
+	PortMappings []*PortMapping
+	// PodIP是sandbox network namespace内分配到的IP，DNAT的目的地址
+	PodIP string
+}
+
+// Manager维护hostPort到podIP:containerPort的映射，并负责把这张表同步到
+// iptables。RunPodSandbox在SetUpPod之后调用Add，StopPodSandbox在
+// TearDownPod之前调用Remove
+type Manager interface {
+	// Add为一个sandbox的全部hostPort建立映射并同步iptables规则；如果和已有
+	// sandbox的hostPort冲突，返回error且不修改iptables
+	Add(id string, podPortMapping *PodPortMapping) error
+	// Remove删除一个sandbox的全部hostPort映射并同步iptables规则
+	Remove(id string, podPortMapping *PodPortMapping) error
+}
+
+// hostport唯一标识一条(hostIP, hostPort, protocol)映射，作为内存表的key，用于
+// 在Reserve阶段检测两个Pod是否声明了同一个hostPort
+type hostport struct {
+	port     int32
+	protocol string
+	hostIP   string
+}
+
+type hostportManager struct {
+	mu sync.Mutex
+	// hostPortMap记录了每个hostport当前被哪个sandbox id占用
+	hostPortMap map[hostport]string
+	// jumpOnce保证CRI-HOSTPORTS/CRI-HOSTPORTS-MASQ这两条chain以及挂载它们的
+	// jump规则在进程生命周期内只被安装一次，不会随着每次Add都重新追加，从而
+	// 避免同样的jump规则在PREROUTING/OUTPUT/POSTROUTING里无限累积
+	jumpOnce sync.Once
+	jumpErr  error
+}
+
+// NewManager创建一个基于iptables-restore的hostport.Manager
+func NewManager() Manager {
+	return &hostportManager{
+		hostPortMap: make(map[hostport]string),
+	}
+}
+
+func (hm *hostportManager) Add(id string, pm *PodPortMapping) error {
+	if pm == nil || pm.PodIP == "" || len(pm.PortMappings) == 0 {
+		return nil
+	}
+	if err := hm.ensureJumpRules(); err != nil {
+		return err
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	// 先做冲突检测，Reserve阶段任何一个端口冲突都整体失败，不做部分生效，
+	// 防止两个Pod同时声明了同一个hostPort
+	reserved, err := hm.reserve(id, pm)
+	if err != nil {
+		return err
+	}
+
+	// 两条chain已经由ensureJumpRules声明过，这里不再写":chain"声明行：
+	// iptables-restore即使带着--noflush，也会清空输入里声明过的已有chain
+	rules := bytes.NewBuffer(nil)
+	writeLine(rules, "*nat")
+
+	for _, entry := range pm.PortMappings {
+		if entry.HostPort <= 0 {
+			continue
+		}
+		protocol := normalizeProtocol(entry.Protocol)
+		comment := fmt.Sprintf("%s/%s hostport %d", pm.Namespace, pm.Name, entry.HostPort)
+		dnatDest := net.JoinHostPort(pm.PodIP, fmt.Sprintf("%d", entry.ContainerPort))
+
+		// DNAT：把目的地址是hostIP:hostPort（或者hostIP为空时，任意地址的
+		// hostPort）的流量转发到podIP:containerPort。显式匹配HostIP才能和
+		// reserve()里按(port, protocol, hostIP)判断冲突的语义保持一致——否则
+		// 两个声明了不同HostIP、reserve()认为不冲突的Pod，会在这里各自装上
+		// 一条不限定目的地址的DNAT规则，实际流量仍然会互相抢占。
+		dnatRule := fmt.Sprintf("-A %s -m comment --comment %q", criHostportsChain, comment)
+		if entry.HostIP != "" {
+			dnatRule += fmt.Sprintf(" -d %s", entry.HostIP)
+		}
+		dnatRule += fmt.Sprintf(" -m %s -p %s --dport %d -j DNAT --to-destination %s",
+			protocol, protocol, entry.HostPort, dnatDest)
+		writeLine(rules, dnatRule)
+
+		// hairpin MASQUERADE：Pod自己访问自己的hostPort时，源地址也要做一次
+		// SNAT，否则回包会走错误的路径导致连接建立不起来，这是kubelet
+		// hostport实现中同样需要的hairpin规则
+		writeLine(rules, fmt.Sprintf(
+			"-A %s -m comment --comment %q -s %s -d %s -p %s --dport %d -j MASQUERADE",
+			criHostportsMasqChain, comment, pm.PodIP, pm.PodIP, protocol, entry.ContainerPort))
+	}
+	writeLine(rules, "COMMIT")
+
+	// --noflush保证这次restore只追加CRI-HOSTPORTS和CRI-HOSTPORTS-MASQ里的
+	// 规则，不影响kube-proxy或CNI插件维护的其他iptables规则
+	if err := restoreIptables(rules.Bytes()); err != nil {
+		hm.releaseAll(reserved)
+		return fmt.Errorf("failed to sync hostport iptables rules for sandbox %q: %v", id, err)
+	}
+	return nil
+}
+
+func (hm *hostportManager) Remove(id string, pm *PodPortMapping) error {
+	if pm == nil || len(pm.PortMappings) == 0 {
+		return nil
+	}
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	var toRelease []hostport
+	for hp, owner := range hm.hostPortMap {
+		if owner == id {
+			toRelease = append(toRelease, hp)
+		}
+	}
+	hm.releaseAll(toRelease)
+
+	// 和Add一样不声明chain，否则chain先被清空，下面的-D找不到规则，整次restore失败
+	rules := bytes.NewBuffer(nil)
+	writeLine(rules, "*nat")
+	for _, entry := range pm.PortMappings {
+		if entry.HostPort <= 0 {
+			continue
+		}
+		protocol := normalizeProtocol(entry.Protocol)
+		comment := fmt.Sprintf("%s/%s hostport %d", pm.Namespace, pm.Name, entry.HostPort)
+		dnatDest := net.JoinHostPort(pm.PodIP, fmt.Sprintf("%d", entry.ContainerPort))
+
+		dnatRule := fmt.Sprintf("-D %s -m comment --comment %q", criHostportsChain, comment)
+		if entry.HostIP != "" {
+			dnatRule += fmt.Sprintf(" -d %s", entry.HostIP)
+		}
+		dnatRule += fmt.Sprintf(" -m %s -p %s --dport %d -j DNAT --to-destination %s",
+			protocol, protocol, entry.HostPort, dnatDest)
+		writeLine(rules, dnatRule)
+
+		writeLine(rules, fmt.Sprintf(
+			"-D %s -m comment --comment %q -s %s -d %s -p %s --dport %d -j MASQUERADE",
+			criHostportsMasqChain, comment, pm.PodIP, pm.PodIP, protocol, entry.ContainerPort))
+	}
+	writeLine(rules, "COMMIT")
+
+	if err := restoreIptables(rules.Bytes()); err != nil {
+		return fmt.Errorf("failed to sync hostport iptables rules for sandbox %q: %v", id, err)
+	}
+	return nil
+}
+
+// reserve在内存表里登记这个sandbox用到的全部hostport，如果其中任何一个已经
+// 被另一个sandbox占用，则整体回滚并返回冲突错误
+func (hm *hostportManager) reserve(id string, pm *PodPortMapping) ([]hostport, error) {
+	var reserved []hostport
+	for _, entry := range pm.PortMappings {
+		if entry.HostPort <= 0 {
+			continue
+		}
+		hp := hostport{port: entry.HostPort, protocol: normalizeProtocol(entry.Protocol), hostIP: entry.HostIP}
+		if owner, ok := hm.hostPortMap[hp]; ok && owner != id {
+			hm.releaseAll(reserved)
+			return nil, fmt.Errorf("hostPort %d/%s is already in use by sandbox %q", hp.port, hp.protocol, owner)
+		}
+		hm.hostPortMap[hp] = id
+		reserved = append(reserved, hp)
+	}
+	return reserved, nil
+}
+
+func (hm *hostportManager) releaseAll(reserved []hostport) {
+	for _, hp := range reserved {
+		delete(hm.hostPortMap, hp)
+	}
+}
+
+func normalizeProtocol(protocol string) string {
+	if protocol == "" {
+		return "tcp"
+	}
+	return protocol
+}
+
+func writeLine(buf *bytes.Buffer, line string) {
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+}
+
+// ensureJumpRules保证CRI-HOSTPORTS/CRI-HOSTPORTS-MASQ这两条chain存在，并且
+// PREROUTING/OUTPUT/POSTROUTING里分别有且只有一条跳转到它们的规则。用
+// sync.Once包一层是为了避免每次调用都去反复probe iptables；probe本身同样是
+// 幂等的（先用`iptables -C`检查规则是否已经存在，不存在才插入），这样即使
+// 在Once触发前已经有遗留的jump规则（比如进程重启），也不会产生重复项。
+func (hm *hostportManager) ensureJumpRules() error {
+	hm.jumpOnce.Do(func() {
+		rules := bytes.NewBuffer(nil)
+		writeLine(rules, "*nat")
+		writeLine(rules, fmt.Sprintf(":%s - [0:0]", criHostportsChain))
+		writeLine(rules, fmt.Sprintf(":%s - [0:0]", criHostportsMasqChain))
+		writeLine(rules, "COMMIT")
+		if err := restoreIptables(rules.Bytes()); err != nil {
+			hm.jumpErr = fmt.Errorf("failed to declare hostport iptables chains: %v", err)
+			return
+		}
+
+		jumps := []struct {
+			table, chain string
+			ruleArgs     []string
+		}{
+			{"nat", "PREROUTING", []string{"-m", "comment", "--comment", "cri hostport map", "-j", criHostportsChain}},
+			{"nat", "OUTPUT", []string{"-m", "comment", "--comment", "cri hostport map", "-j", criHostportsChain}},
+			{"nat", "POSTROUTING", []string{"-m", "comment", "--comment", "cri hostport masquerade", "-j", criHostportsMasqChain}},
+		}
+		for _, jump := range jumps {
+			exists, err := iptablesRuleExists(jump.table, jump.chain, jump.ruleArgs)
+			if err != nil {
+				hm.jumpErr = fmt.Errorf("failed to check jump rule in %s/%s: %v", jump.table, jump.chain, err)
+				return
+			}
+			if exists {
+				continue
+			}
+			args := append([]string{"-t", jump.table, "-I", jump.chain, "1"}, jump.ruleArgs...)
+			if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+				hm.jumpErr = fmt.Errorf("failed to install jump rule in %s/%s: %v, output: %s", jump.table, jump.chain, err, out)
+				return
+			}
+		}
+	})
+	return hm.jumpErr
+}
+
+// iptablesRuleExists用`iptables -C`探测一条规则是否已经存在：exit code为0表示
+// 存在，exit code为1表示不存在，其他错误（比如chain不存在）原样返回
+func iptablesRuleExists(table, chain string, ruleArgs []string) (bool, error) {
+	args := append([]string{"-t", table, "-C", chain}, ruleArgs...)
+	cmd := exec.Command("iptables", args...)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("iptables -C failed: %v, output: %s", err, out)
+}
+
+// restoreIptables通过`iptables-restore --noflush`把rules应用到nat表，
+// --noflush确保本次调用只影响rules里显式提到的chain
+func restoreIptables(rules []byte) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = bytes.NewReader(rules)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		glog.Errorf("iptables-restore failed: %v, output: %s", err, out)
+		return fmt.Errorf("iptables-restore failed: %v, output: %s", err, out)
+	}
+	return nil
+}
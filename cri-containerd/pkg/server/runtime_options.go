@@ -0,0 +1,117 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/linux/runcopts"
+	"github.com/containerd/typeurl"
+)
+
+// RuntimeConfig配置了一个可以被CRI RuntimeHandler选中的container runtime，对应
+// PluginConfig.ContainerdConfig.Runtimes这个map中的一项，map的key就是
+// RuntimeHandler。这使得同一个节点可以同时运行多个runtime（如runc、kata、
+// gVisor），由上层调度器通过PodSandboxConfig.RuntimeHandler指定。
+type RuntimeConfig struct {
+	// Type是containerd侧注册的runtime名字，如"io.containerd.runtime.v1.linux"
+	// 或shim v2的"io.containerd.kata.v2"
+	Type string
+	// Engine是"io.containerd.runtime.v1.linux" shim使用的OCI runtime二进制，如runc，
+	// 非runc shim不使用这个字段
+	Engine string
+	// Root是shim用来存放runtime状态的目录，非runc shim不使用这个字段
+	Root string
+	// Options是shim私有的配置，会通过typeurl序列化后传给shim，由shim自己解析，
+	// 只有非runc shim（如kata）才需要配置。typeurl只认识事先通过typeurl.Register
+	// 注册过的具体类型，所以这里必须是该shim自己的options类型（如kata-runtime
+	// 的hypervisor配置结构体）的指针，不能是裸的map[string]interface{}——后者
+	// 在MarshalAny时会直接返回"type not registered"错误。
+	Options interface{}
+}
+
+// getSandboxRuntime根据RuntimeHandler在c.config.ContainerdConfig.Runtimes中查找
+// 对应的RuntimeConfig。RuntimeHandler为空字符串时代表请求没有指定handler，此时
+// 沿用全局默认配置的runtime（即ContainerdConfig.Runtime/RuntimeEngine/RuntimeRoot），
+// 从而保证只配置了单一runtime的集群行为不变。
+func (c *criContainerdService) getSandboxRuntime(runtimeHandler string) (RuntimeConfig, error) {
+	if runtimeHandler == "" {
+		return RuntimeConfig{
+			Type:   c.config.ContainerdConfig.Runtime,
+			Engine: c.config.ContainerdConfig.RuntimeEngine,
+			Root:   c.config.ContainerdConfig.RuntimeRoot,
+		}, nil
+	}
+	runtimeConfig, ok := c.config.ContainerdConfig.Runtimes[runtimeHandler]
+	if !ok {
+		return RuntimeConfig{}, fmt.Errorf("no runtime config was configured for runtime handler %q", runtimeHandler)
+	}
+	return runtimeConfig, nil
+}
+
+// runtimeNewContainerOpts把一个RuntimeConfig转换成containerd.NewContainerOpts。
+// 对于没有配置Options的runtime（典型的就是runc shim），沿用原来的RuncOptions；
+// 对于配置了Options的non-runc shim（如kata），将Options通过typeurl序列化成Any，
+// 由shim自己按照其私有类型解析，因此这里不能再无条件传RuncOptions。
+func (c *criContainerdService) runtimeNewContainerOpts(runtimeConfig RuntimeConfig) (containerd.NewContainerOpts, error) {
+	if runtimeConfig.Options == nil {
+		return containerd.WithRuntime(
+			runtimeConfig.Type,
+			&runcopts.RuncOptions{
+				Runtime:       runtimeConfig.Engine,
+				RuntimeRoot:   runtimeConfig.Root,
+				SystemdCgroup: c.config.SystemdCgroup,
+			}), nil
+	}
+	// runtimeConfig.Options必须是一个已经通过typeurl.Register注册过的具体类型
+	// 的指针，typeurl无法序列化裸的map——配置解析层负责把PluginConfig里对应
+	// handler的原始配置解码成该shim自己的options类型，而不是留成一个map。
+	runtimeOpts, err := typeurl.MarshalAny(runtimeConfig.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal runtime options for runtime %q (Options must be a typeurl-registered concrete type, not a map): %v", runtimeConfig.Type, err)
+	}
+	return containerd.WithRuntime(runtimeConfig.Type, runtimeOpts), nil
+}
+
+// validateRuntimeHandlers在server启动的时候被调用一次，检查每一个配置的
+// RuntimeHandler对应的shim二进制是否确实安装在PATH中，从而尽早暴露配置错误，
+// 而不是等到第一个使用该handler的Pod调度过来时才失败。
+func validateRuntimeHandlers(runtimes map[string]RuntimeConfig) error {
+	for handler, runtimeConfig := range runtimes {
+		shim := shimBinaryName(runtimeConfig.Type)
+		if _, err := exec.LookPath(shim); err != nil {
+			return fmt.Errorf("invalid runtime handler %q: shim %q for runtime type %q is not installed: %v",
+				handler, shim, runtimeConfig.Type, err)
+		}
+	}
+	return nil
+}
+
+// shimBinaryName将containerd runtime v2 type（如io.containerd.kata.v2）转换成
+// 对应的shim可执行文件名（containerd-shim-kata-v2），符合runtime v2 shim的命名
+// 约定；对不遵循这个约定的v1 runtime（如io.containerd.runtime.v1.linux）直接
+// 返回通用的containerd-shim。
+func shimBinaryName(runtimeType string) string {
+	parts := strings.Split(runtimeType, ".")
+	if len(parts) < 3 || parts[len(parts)-1] == "linux" {
+		return "containerd-shim"
+	}
+	return "containerd-shim-" + strings.Join(parts[len(parts)-2:], "-")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/containerd/containerd"
+	"github.com/cri-o/ocicni/pkg/ocicni"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+// toCNIPodNetwork根据一个已经持久化的sandbox记录重建出TearDownPod需要的
+// ocicni.PodNetwork，字段含义和RunPodSandbox里构造的podNetwork完全一致
+func toCNIPodNetwork(sandbox sandboxstore.Sandbox) ocicni.PodNetwork {
+	return ocicni.PodNetwork{
+		Name:         sandbox.Config.GetMetadata().GetName(),
+		Namespace:    sandbox.Config.GetMetadata().GetNamespace(),
+		ID:           sandbox.ID,
+		NetNS:        sandbox.NetNSPath,
+		PortMappings: toCNIPortMappings(sandbox.Config.GetPortMappings()),
+	}
+}
+
+// reconcileSandboxes在server启动的时候被调用一次，遍历sandboxStore里所有处于
+// StateUnknown的sandbox。之所以会存在StateUnknown的sandbox，是因为
+// RunPodSandbox在把sandbox加入store之后（netns创建、container创建和task启动
+// 都在这之后）、把状态更新为StateReady之前，cri-containerd本身崩溃了；这些
+// sandbox既没有被完整地创建出来，也没有被清理掉。
+// reconcileSandboxes会向containerd重新确认每一个这样的sandbox的真实状态，
+// 要么把它们promote成StateReady（容器和task都还活着，netns也还在），要么执行
+// 完整的清理（删除container/task、回收netns、释放name index），使
+// RunPodSandbox重新具备crash-safe语义。
+func (c *criContainerdService) reconcileSandboxes(ctx context.Context) {
+	for _, sandbox := range c.sandboxStore.List() {
+		if sandbox.Status.State != sandboxstore.StateUnknown {
+			continue
+		}
+		glog.Warningf("Reconciling sandbox %q left in StateUnknown by a previous run", sandbox.ID)
+		if c.sandboxIsRunning(ctx, sandbox) {
+			sandbox.Status.State = sandboxstore.StateReady
+			if err := c.sandboxStore.Update(sandbox); err != nil {
+				glog.Errorf("Failed to promote sandbox %q to StateReady: %v", sandbox.ID, err)
+			}
+			continue
+		}
+		c.cleanupUnknownSandbox(ctx, sandbox)
+	}
+}
+
+// sandboxIsRunning通过查询containerd的container/task以及探测netns，判断一个
+// StateUnknown的sandbox实际上是不是已经正常启动了
+func (c *criContainerdService) sandboxIsRunning(ctx context.Context, sandbox sandboxstore.Sandbox) bool {
+	container, err := c.client.LoadContainer(ctx, sandbox.ID)
+	if err != nil {
+		return false
+	}
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return false
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status != containerd.Running {
+		return false
+	}
+	if sandbox.NetNSPath != "" {
+		if closed, err := sandbox.NetNS.Closed(); err != nil || closed {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanupUnknownSandbox对一个确认没有启动成功的StateUnknown sandbox执行完整
+// 清理：删除containerd里的task/container，拆除网络，回收netns，释放name
+// index，并最终把记录从sandboxStore中移除，行为上和RunPodSandbox失败时的
+// 清理路径保持一致。
+func (c *criContainerdService) cleanupUnknownSandbox(ctx context.Context, sandbox sandboxstore.Sandbox) {
+	if container, err := c.client.LoadContainer(ctx, sandbox.ID); err == nil {
+		if task, err := container.Task(ctx, nil); err == nil {
+			if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+				glog.Errorf("Failed to delete task for sandbox %q: %v", sandbox.ID, err)
+			}
+		}
+		if err := container.Delete(ctx, containerd.WithSnapshotCleanup); err != nil {
+			glog.Errorf("Failed to delete container for sandbox %q: %v", sandbox.ID, err)
+		}
+	}
+
+	if sandbox.NetNSPath != "" {
+		podNetwork := toCNIPodNetwork(sandbox)
+		if err := c.netPlugin.TearDownPod(podNetwork); err != nil {
+			glog.Errorf("Failed to tear down network for sandbox %q: %v", sandbox.ID, err)
+		}
+		if err := sandbox.NetNS.Remove(); err != nil {
+			glog.Errorf("Failed to remove netns for sandbox %q: %v", sandbox.ID, err)
+		}
+	}
+
+	if err := c.os.RemoveAll(getSandboxRootDir(c.config.RootDir, sandbox.ID)); err != nil {
+		glog.Errorf("Failed to remove root directory for sandbox %q: %v", sandbox.ID, err)
+	}
+
+	c.sandboxNameIndex.ReleaseByName(sandbox.Name)
+	if err := c.sandboxStore.Delete(sandbox.ID); err != nil {
+		glog.Errorf("Failed to delete sandbox %q from store: %v", sandbox.ID, err)
+	}
+}
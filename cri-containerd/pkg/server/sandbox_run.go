@@ -19,10 +19,10 @@ package server
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/linux/runcopts"
 	"github.com/containerd/typeurl"
 	"github.com/cri-o/ocicni/pkg/ocicni"
 	"github.com/golang/glog"
@@ -33,11 +33,23 @@ import (
 	"golang.org/x/sys/unix"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/kubernetes-incubator/cri-containerd/pkg/apparmor"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/cgroups"
 	customopts "github.com/kubernetes-incubator/cri-containerd/pkg/containerd/opts"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/server/hostport"
 	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/util"
 )
 
+// hostportManagerCNI和hostportManagerInternal是PluginConfig.HostportManager
+// 可以取的两个值：前者沿用现在依赖CNI portmap插件的行为，后者启用pkg/server/hostport
+// 包里的hostport.Manager，通过独立维护的iptables chain实现确定性的hostPort映射，
+// 适用于所配置的CNI插件没有实现portmap插件的集群
+const (
+	hostportManagerCNI      = "cni"
+	hostportManagerInternal = "internal"
+)
+
 func init() {
 	typeurl.Register(&sandboxstore.Metadata{},
 		"github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox", "Metadata")
@@ -68,15 +80,64 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		}
 	}()
 
+	// Get the runtime configuration for the handler requested by the caller (kata,
+	// gVisor, runc, ...). An empty RuntimeHandler falls back to the globally
+	// configured default runtime so single-runtime clusters are unaffected.
+	// RuntimeHandler由RunPodSandboxRequest指定，用于支持pluggable runtime，为空时
+	// 使用全局默认配置的runtime
+	runtimeHandler := r.GetRuntimeHandler()
+	ociRuntime, err := c.getSandboxRuntime(runtimeHandler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sandbox runtime handler %q: %v", runtimeHandler, err)
+	}
+	glog.V(2).Infof("Use OCI runtime %+v for sandbox %q", ociRuntime, id)
+
 	// Create initial internal sandbox object.
-	// 创建初始的内部的sandbox对象
+	// 创建初始的内部的sandbox对象，RuntimeHandler会被持久化到sandbox的元数据中，
+	// 这样StartContainer创建workload container时可以复用同一个handler
 	sandbox := sandboxstore.Sandbox{
 		Metadata: sandboxstore.Metadata{
-			ID:     id,
-			Name:   name,
-			Config: config,
+			ID:             id,
+			Name:           name,
+			Config:         config,
+			RuntimeHandler: runtimeHandler,
 		},
 	}
+	// StateUnknown是sandbox刚被创建时的初始状态：cri-containerd还没能确认这个
+	// sandbox究竟有没有成功启动。只有在task.Start成功之后才会被置为
+	// StateReady，如果cri-containerd在netns创建、container创建或者task启动
+	// 期间崩溃，重启后看到的就是停留在StateUnknown的sandbox，交由下面的
+	// reconciler处理，而不是像之前那样完全没有记录、变成泄露的资源。
+	sandbox.Status.State = sandboxstore.StateUnknown
+
+	// Add the sandbox into the store *before* any external side effect (netns
+	// creation, container creation, task start) so that a crash anywhere after
+	// this point leaves a StateUnknown record behind for reconcileSandboxes to
+	// pick up on the next startup, instead of leaking the sandbox silently.
+	// Fields that are only filled in later (NetNSPath) are re-persisted with a
+	// follow-up sandboxStore.Update as soon as they're set, see below.
+	// 在做任何外部副作用之前，先把sandbox（此时状态为StateUnknown）写入
+	// sandboxStore并持久化，这样即使后续步骤中cri-containerd崩溃，这个sandbox
+	// 也不会彻底丢失记录；NetNSPath这种之后才会填上的字段，会在填上之后马上
+	// 用sandboxStore.Update再持久化一次，见下文
+	if err := c.sandboxStore.Add(sandbox); err != nil {
+		return nil, fmt.Errorf("failed to add sandbox %+v into store: %v", sandbox, err)
+	}
+	defer func() {
+		if retErr != nil {
+			// By the time we get here all the other deferred cleanups (netns,
+			// network, container, task, root dir) have already run, so it's
+			// safe to simply forget this sandbox instead of leaving a
+			// StateUnknown record that the reconciler would otherwise have to
+			// clean up on the next restart.
+			// 走到这里说明其他所有的defer清理工作都已经执行完毕，sandbox已经
+			// 被完全清理干净，所以可以直接把它从store中删除，而不需要等
+			// reconciler在下次启动时再去处理一个实际上已经不存在的sandbox
+			if err := c.sandboxStore.Delete(id); err != nil {
+				glog.Errorf("Failed to delete sandbox %q from store: %v", id, err)
+			}
+		}
+	}()
 
 	// Ensure sandbox container image snapshot.
 	// ensureImageExists用来返回镜像的元数据，如果镜像不存在的话，会自动下载镜像
@@ -108,6 +169,18 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 				sandbox.NetNSPath = ""
 			}
 		}()
+		// Persist NetNSPath before calling into the CNI plugin: the record added
+		// above by sandboxStore.Add still has an empty NetNSPath, so a crash
+		// between here and the final StateReady update would otherwise leave a
+		// StateUnknown record that cleanupUnknownSandbox can't map back to the
+		// netns it just created, leaking it.
+		// 在调用CNI插件之前先把带有NetNSPath的sandbox记录重新持久化一次：上面
+		// sandboxStore.Add写入的记录里NetNSPath还是空的，如果在这之后、task启动
+		// 之前的StateReady更新之前崩溃，reconciler看到的StateUnknown记录就没有
+		// NetNSPath可用，无法找到并清理这个刚创建出来的netns，造成泄露
+		if err := c.sandboxStore.Update(sandbox); err != nil {
+			return nil, fmt.Errorf("failed to update sandbox %+v in store: %v", sandbox, err)
+		}
 		// Setup network for sandbox.
 		podNetwork := ocicni.PodNetwork{
 			Name:         config.GetMetadata().GetName(),
@@ -130,6 +203,27 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 				}
 			}
 		}()
+
+		// 如果配置了internal hostport manager，则不依赖CNI portmap插件，而是
+		// 由cri-containerd自己维护一条独立的iptables chain来做hostPort的DNAT，
+		// 行为上和kubelet自带的hostport实现保持一致
+		if c.config.HostportManager == hostportManagerInternal {
+			status, err := c.netPlugin.GetPodNetworkStatus(podNetwork)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get pod network status for sandbox %q: %v", id, err)
+			}
+			podPortMapping := toHostportPodPortMapping(config, status.IP)
+			if err := c.hostportManager.Add(id, podPortMapping); err != nil {
+				return nil, fmt.Errorf("failed to add hostport mapping for sandbox %q: %v", id, err)
+			}
+			defer func() {
+				if retErr != nil {
+					if err := c.hostportManager.Remove(id, podPortMapping); err != nil {
+						glog.Errorf("Failed to remove hostport mapping for sandbox %q: %v", id, err)
+					}
+				}
+			}()
+		}
 	}
 
 	// Create sandbox container.
@@ -163,6 +257,13 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 	// buildLabels返回一个map[string]string结构
 	sandboxLabels := buildLabels(config.Labels, containerKindSandbox)
 
+	// runtime相关的选项，根据ociRuntime.Options是否为空选择runc shim的RuncOptions，
+	// 或者把non-runc shim（如kata）的私有Options通过typeurl传下去
+	runtimeOpts, err := c.runtimeNewContainerOpts(ociRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container runtime options: %v", err)
+	}
+
 	// 设置containrd新建容器的选项
 	opts := []containerd.NewContainerOpts{
 		// c.config.ContainerConfig.Snapshotter默认为"overlayfs"
@@ -175,15 +276,7 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 		containerd.WithContainerLabels(sandboxLabels),
 		// 将sandbox的元数据作为extension存储
 		containerd.WithContainerExtension(sandboxMetadataExtension, &sandbox.Metadata),
-		// runtime相关的选项
-		containerd.WithRuntime(
-			// Runtime默认为"io.containerd.runtime.v1.linux"
-			c.config.ContainerdConfig.Runtime,
-			&runcopts.RuncOptions{
-				// RuntimeEngine和RuntimeRoot的默认为""
-				Runtime:       c.config.ContainerdConfig.RuntimeEngine,
-				RuntimeRoot:   c.config.ContainerdConfig.RuntimeRoot,
-				SystemdCgroup: c.config.SystemdCgroup})} // TODO (mikebrow): add CriuPath when we add support for pause
+		runtimeOpts} // TODO (mikebrow): add CriuPath when we add support for pause
 
 	// 调用containerd client创建container
 	container, err := c.client.NewContainer(ctx, id, opts...)
@@ -256,11 +349,14 @@ func (c *criContainerdService) RunPodSandbox(ctx context.Context, r *runtime.Run
 			id, err)
 	}
 
-	// Add sandbox into sandbox store.
-	// 将sandbox加入sandbox store
+	// The sandbox container and its task are up, promote the sandbox record
+	// (already persisted above as StateUnknown) to StateReady.
+	// task已经成功启动，将之前以StateUnknown状态写入store的sandbox记录更新为
+	// StateReady，并补上container引用
 	sandbox.Container = container
-	if err := c.sandboxStore.Add(sandbox); err != nil {
-		return nil, fmt.Errorf("failed to add sandbox %+v into store: %v", sandbox, err)
+	sandbox.Status.State = sandboxstore.StateReady
+	if err := c.sandboxStore.Update(sandbox); err != nil {
+		return nil, fmt.Errorf("failed to update sandbox %+v in store: %v", sandbox, err)
 	}
 
 	return &runtime.RunPodSandboxResponse{PodSandboxId: id}, nil
@@ -311,6 +407,9 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 
 	// Set cgroups parent.
 	// 设置cgroups parent
+	// getCgroupsPath在cgroup v1和cgroup v2下生成同一个路径，不检查宿主机的层级；
+	// c.config.SystemdCgroup决定使用systemd的"<slice>:cri-containerd:<id>"形式
+	// 还是cgroupfs的相对路径形式
 	if config.GetLinux().GetCgroupParent() != "" {
 		cgroupsPath := getCgroupsPath(config.GetLinux().GetCgroupParent(), id,
 			c.config.SystemdCgroup)
@@ -362,10 +461,40 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 		g.AddLinuxSysctl(key, value)
 	}
 
-	// Note: LinuxSandboxSecurityContext does not currently provide an apparmor profile
+	// Set AppArmor profile.
+	// LinuxSandboxSecurityContext目前没有提供显式的apparmor profile字段，所以
+	// 这里在宿主机支持AppArmor时，默认使用runtime/default profile（内核里还没有
+	// 加载这个默认profile时，spec里不设置任何profile），和
+	// workload容器可以显式指定profile的行为互补；c.apparmorEnabled由server
+	// 启动时的探测结果决定，在只有SELinux的发行版上恒为false，直接no-op
+	apparmorSpecOpts, err := apparmor.GenerateSpecOpts(
+		apparmor.ProfileRuntimeDefault, securityContext.GetPrivileged(), c.apparmorEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate apparmor spec opts: %v", err)
+	}
+	if apparmorSpecOpts != nil {
+		if err := apparmorSpecOpts(nil, nil, nil, g.Spec()); err != nil {
+			return nil, fmt.Errorf("failed to apply apparmor spec opts: %v", err)
+		}
+	}
 
 	// 设置sandbox的共享CPU的数目
-	g.SetLinuxResourcesCPUShares(uint64(defaultSandboxCPUshares))
+	// cgroup v1使用cpu.shares，cgroup v2下该knob不存在，需要换算成cpu.weight
+	// 并写入resources.unified，因此这里需要先判断宿主机的cgroup层级
+	if cgroups.IsUnifiedMode() {
+		weight := cgroups.CPUSharesToV2Weight(uint64(defaultSandboxCPUshares))
+		resources := g.Spec().Linux.Resources
+		if resources == nil {
+			resources = &runtimespec.LinuxResources{}
+			g.Spec().Linux.Resources = resources
+		}
+		if resources.Unified == nil {
+			resources.Unified = make(map[string]string)
+		}
+		resources.Unified["cpu.weight"] = strconv.FormatUint(weight, 10)
+	} else {
+		g.SetLinuxResourcesCPUShares(uint64(defaultSandboxCPUshares))
+	}
 	g.SetProcessOOMScoreAdj(int(defaultSandboxOOMAdj))
 
 	// 返回根据镜像配置以及其他一些默认参数修改后的spec
@@ -466,6 +595,31 @@ func (c *criContainerdService) unmountSandboxFiles(rootDir string, config *runti
 	return nil
 }
 
+// toHostportPodPortMapping converts a PodSandboxConfig's port mappings plus the
+// sandbox's pod IP into the hostport.PodPortMapping consumed by the internal
+// hostport.Manager.
+// toHostportPodPortMapping将CRI的port mapping和sandbox的pod IP转换为
+// hostport.Manager使用的PodPortMapping
+func toHostportPodPortMapping(config *runtime.PodSandboxConfig, podIP string) *hostport.PodPortMapping {
+	podPortMapping := &hostport.PodPortMapping{
+		Name:      config.GetMetadata().GetName(),
+		Namespace: config.GetMetadata().GetNamespace(),
+		PodIP:     podIP,
+	}
+	for _, mapping := range config.GetPortMappings() {
+		if mapping.HostPort <= 0 {
+			continue
+		}
+		podPortMapping.PortMappings = append(podPortMapping.PortMappings, &hostport.PortMapping{
+			HostPort:      mapping.HostPort,
+			ContainerPort: mapping.ContainerPort,
+			Protocol:      strings.ToLower(mapping.Protocol.String()),
+			HostIP:        mapping.HostIp,
+		})
+	}
+	return podPortMapping
+}
+
 // toCNIPortMappings converts CRI port mappings to CNI.
 func toCNIPortMappings(criPortMappings []*runtime.PortMapping) []ocicni.PortMapping {
 	var portMappings []ocicni.PortMapping
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/cri-o/ocicni/pkg/ocicni"
+	"golang.org/x/net/context"
+
+	"github.com/kubernetes-incubator/cri-containerd/pkg/apparmor"
+	osinterface "github.com/kubernetes-incubator/cri-containerd/pkg/os"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/registrar"
+	"github.com/kubernetes-incubator/cri-containerd/pkg/server/hostport"
+	sandboxstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/sandbox"
+)
+
+// seccompProfileRoot是内核暴露seccomp支持的位置，和apparmor.IsEnabled()探测
+// /sys/kernel/security/apparmor/profiles是否存在的方式类似
+const seccompProfileRoot = "/proc/sys/kernel/seccomp"
+
+// isSeccompSupported探测当前内核是否编译了seccomp支持
+func isSeccompSupported() bool {
+	_, err := os.Stat(seccompProfileRoot)
+	return err == nil
+}
+
+// ContainerdConfig配置了连接containerd以及选择container runtime使用的全部参数
+type ContainerdConfig struct {
+	// Snapshotter是containerd使用的snapshotter，默认为"overlayfs"
+	Snapshotter string
+	// Runtime/RuntimeEngine/RuntimeRoot是没有显式指定RuntimeHandler时使用的
+	// 默认runtime配置
+	Runtime       string
+	RuntimeEngine string
+	RuntimeRoot   string
+	// Runtimes是RuntimeHandler到RuntimeConfig的映射，支持同一节点运行多个runtime
+	Runtimes map[string]RuntimeConfig
+}
+
+// Config是cri-containerd server的全部配置项
+type Config struct {
+	ContainerdConfig
+	// RootDir是cri-containerd存放sandbox/container根目录的位置，默认为
+	// /var/lib/cri-containerd
+	RootDir string
+	// SandboxImage是sandbox container使用的pause镜像
+	SandboxImage string
+	// SystemdCgroup为true时使用systemd cgroup driver，否则使用cgroupfs driver
+	SystemdCgroup bool
+	// HostportManager选择hostPort的实现方式，取值为hostportManagerCNI或
+	// hostportManagerInternal
+	HostportManager string
+}
+
+// criContainerdService是CRI RuntimeService/ImageService的实现
+type criContainerdService struct {
+	config           Config
+	os               osinterface.OS
+	client           *containerd.Client
+	netPlugin        ocicni.CNIPlugin
+	sandboxStore     *sandboxstore.Store
+	sandboxNameIndex *registrar.Registrar
+	hostportManager  hostport.Manager
+	// apparmorEnabled和seccompEnabled在server启动时探测一次，之后在sandbox/
+	// container的spec生成过程中被反复读取，避免每次都重新探测宿主机能力
+	apparmorEnabled bool
+	seccompEnabled  bool
+}
+
+// NewCriContainerdService创建一个criContainerdService，完成所有只需要在进程
+// 启动时做一次的探测和校验：宿主机是否支持AppArmor/seccomp，以及配置的每一个
+// RuntimeHandler对应的shim二进制是否确实安装，从而尽早暴露配置错误，而不是
+// 等到第一个Pod调度过来时才失败。
+func NewCriContainerdService(config Config, client *containerd.Client, netPlugin ocicni.CNIPlugin) (*criContainerdService, error) {
+	if err := validateRuntimeHandlers(config.ContainerdConfig.Runtimes); err != nil {
+		return nil, err
+	}
+	c := &criContainerdService{
+		config:           config,
+		os:               osinterface.RealOS{},
+		client:           client,
+		netPlugin:        netPlugin,
+		sandboxStore:     sandboxstore.NewStore(),
+		sandboxNameIndex: registrar.NewRegistrar(),
+		hostportManager:  hostport.NewManager(),
+		apparmorEnabled:  apparmor.IsEnabled(),
+		seccompEnabled:   isSeccompSupported(),
+	}
+	return c, nil
+}
+
+// Run启动server的后台任务。目前唯一的后台任务是reconcileSandboxes：在接受
+// 任何CRI请求之前，先把上一次运行遗留下来的StateUnknown sandbox逐一确认并
+// 清理或promote，使RunPodSandbox具备的crash-safe语义能够在进程重启后真正
+// 生效，而不是停留在永远不会被触发的代码里。
+func (c *criContainerdService) Run(ctx context.Context) error {
+	c.reconcileSandboxes(ctx)
+	<-ctx.Done()
+	return ctx.Err()
+}
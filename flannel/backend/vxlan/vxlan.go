@@ -0,0 +1,147 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func init() {
+	backend.Register("vxlan", New)
+}
+
+const (
+	defaultVNI  = 1
+	defaultPort = 0
+)
+
+// Config是vxlan backend的JSON配置，对应net-conf.json里的"Backend"字段，例如
+// {"Type":"vxlan","VNI":1,"EnableIPv4":true,"EnableIPv6":true}。v4总是启用，
+// 打开EnableIPv6即成为dual-stack；不支持只有v6的单栈模式。
+type Config struct {
+	VNI           int
+	Port          int
+	GBP           bool
+	DirectRouting bool
+	MacPrefix     string
+	// EnableIPv6决定这台主机要不要在lease里公布PublicIPv6和VtepMAC6，以及
+	// handleSubnetEvents要不要编程v6的路由和neighbor表项（对端lease没有
+	// VtepMAC6时同样跳过）。EnableIPv4只出现在日志里：v4的lease申请、VTEP
+	// 公布和路由/neighbor编程不论它取什么值都会进行
+	EnableIPv4 bool
+	EnableIPv6 bool
+	// Encrypt开启节点间vxlan流量的IPsec加密，见vxlan_network.go顶部的说明
+	Encrypt bool
+}
+
+// VXLANBackend实现了backend.Backend，负责根据Config申请lease、创建vxlan设备
+// 并构造network
+type VXLANBackend struct {
+	subnetMgr subnet.Manager
+	extIface  *backend.ExternalInterface
+}
+
+// New创建一个VXLANBackend，subnetMgr用于申请/监听lease，extIface是选中的对外
+// 网络接口
+func New(subnetMgr subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	return &VXLANBackend{subnetMgr: subnetMgr, extIface: extIface}, nil
+}
+
+// RegisterNetwork解析Config，创建vxlan设备，生成本机的vxlanLeaseAttrs
+// （VtepMAC、按需生成的VtepMAC6/PublicKey），通过subnetMgr申请lease，最后
+// 构造并返回network。
+func (be *VXLANBackend) RegisterNetwork(ctx backend.Context, config *Config) (*network, error) {
+	if config.VNI == 0 {
+		config.VNI = defaultVNI
+	}
+
+	devAttrs := vxlanDeviceAttrs{
+		vni:       uint32(config.VNI),
+		name:      fmt.Sprintf("flannel.%v", config.VNI),
+		vtepIndex: be.extIface.Iface.Index,
+		vtepAddr:  be.extIface.IfaceAddr,
+		vtepPort:  config.Port,
+		gbp:       config.GBP,
+	}
+	dev, err := newVXLANDevice(&devAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vxlan device: %v", err)
+	}
+	dev.directRouting = config.DirectRouting
+
+	// 本机的vxlanLeaseAttrs：VtepMAC总是填充，VtepMAC6只有在EnableIPv6打开时
+	// 才填充——这样关闭了IPv6的单栈集群看到的lease attrs和原来完全一样。
+	vxlanAttrs := vxlanLeaseAttrs{
+		VtepMAC: hardwareAddr(dev.MACAddr()),
+	}
+	if config.EnableIPv6 {
+		vxlanAttrs.VtepMAC6 = hardwareAddr(dev.MACAddr())
+	}
+
+	// Encrypt打开时，在这里（而不是等到第一次handleSubnetEvents）就生成本机
+	// 的Curve25519密钥对：私钥留在内存里供deriveSessionKey做ECDH，公钥随
+	// lease一起公布给其他节点，这样对端从一开始收到的lease就带有可用的
+	// PublicKey，不需要等一次密钥轮转才能建立SA。
+	var privateKey [32]byte
+	if config.Encrypt {
+		if _, err := rand.Read(privateKey[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate IPsec private key: %v", err)
+		}
+		var publicKey [32]byte
+		curve25519.ScalarBaseMult(&publicKey, &privateKey)
+		vxlanAttrs.PublicKey = publicKey[:]
+	}
+
+	data, err := json.Marshal(&vxlanAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal vxlan lease attrs: %v", err)
+	}
+
+	leaseAttrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		BackendType: "vxlan",
+		BackendData: json.RawMessage(data),
+	}
+	if config.EnableIPv6 {
+		leaseAttrs.PublicIPv6 = ip.FromIP6(be.extIface.ExtAddr)
+	}
+
+	// 总是带上v4的PublicIP，只有打开EnableIPv6时才带上PublicIPv6；AcquireLease
+	// 会在lease里对应字段上填上分配到的Subnet/Subnet6
+	lease, err := be.subnetMgr.AcquireLease(ctx, &leaseAttrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+	}
+
+	log.Infof("vxlan backend enabled: IPv4=%v IPv6=%v Encrypt=%v", config.EnableIPv4, config.EnableIPv6, config.Encrypt)
+
+	nw, err := newNetwork(be.subnetMgr, be.extIface, dev, ip.IP4Net{}, lease)
+	if err != nil {
+		return nil, err
+	}
+	nw.encrypt = config.Encrypt
+	nw.privateKey = privateKey
+	nw.enableIPv6 = config.EnableIPv6
+	return nw, nil
+}
@@ -12,10 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// package vxlan的后端配置（见vxlan.go）新增了EnableIPv4/EnableIPv6两个开关，
+// 例如{"Type":"vxlan","EnableIPv4":true,"EnableIPv6":true}。v4侧总是启用，
+// EnableIPv4只出现在日志里；handleSubnetEvents对每个vxlan lease都编程v4的
+// 路由和neighbor表项，v6侧只有在本机打开了EnableIPv6、且lease带有VtepMAC6时
+// 才编程。只有v6的单栈模式不受支持
+//
+// 配置里还可以加上"Encrypt":true来开启节点间vxlan流量的IPsec加密，例如
+// {"Type":"vxlan","Encrypt":true}，开启后每个节点会生成一对Curve25519密钥，
+// 公钥通过vxlanLeaseAttrs.PublicKey公布，和对端的公钥做ECDH推导出会话密钥，
+// 用于pkg/ip/xfrm建立的ESP-in-UDP SA
 package vxlan
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 
@@ -25,16 +36,42 @@ import (
 
 	"syscall"
 
+	"golang.org/x/crypto/curve25519"
+
 	"github.com/coreos/flannel/backend"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/ip/xfrm"
 	"github.com/coreos/flannel/subnet"
 )
 
+// neighStateV6是v6邻居表项（NDP的ND neighbor cache entry）的状态，PERMANENT
+// 表示这条表项是静态配置的，内核不会对它做老化或者重新探测，和v4下ARP表项的
+// 处理方式一致
+const neighStateV6 = netlink.NUD_PERMANENT
+
 type network struct {
 	backend.SimpleNetwork
 	extIface  *backend.ExternalInterface
 	dev       *vxlanDevice
 	subnetMgr subnet.Manager
+
+	// encrypt为true时，handleSubnetEvents会在常规的ARP/FDB/路由编程之外，额外
+	// 为每一个对端节点建立一对IPsec transport-mode SA/SP，对node-to-node的
+	// vxlan（ESP-in-UDP）流量做透明加密
+	encrypt bool
+	// privateKey是本节点的Curve25519私钥，在backend启动时生成一次，配合对端
+	// 通过vxlanLeaseAttrs.PublicKey公布的公钥做ECDH，推导出每一对节点各自的
+	// 会话密钥
+	privateKey [32]byte
+	// sessionKeys记录了当前每个对端公钥所对应的会话密钥，用来判断successive
+	// 的lease事件里对端是否发生了密钥轮转，从而决定是否需要原子地替换SA
+	sessionKeys map[string][]byte
+	// enableIPv6是本机Config.EnableIPv6的值。v6侧的编程除了要求对端lease带有
+	// VtepMAC6之外，还必须本机自己也打开了EnableIPv6才能进行：否则一个v4-only
+	// 的单栈节点在混合集群里收到dual-stack对端的lease时，会在自己从未创建过v6
+	// VTEP地址的设备上尝试NeighAdd/RouteReplace，编程出一堆没有意义、甚至可能
+	// 和本机其他v6配置冲突的状态
+	enableIPv6 bool
 }
 
 func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease) (*network, error) {
@@ -43,8 +80,9 @@ func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, d
 			SubnetLease: lease,
 			ExtIface:    extIface,
 		},
-		subnetMgr: subnetMgr,
-		dev:       dev,
+		subnetMgr:   subnetMgr,
+		dev:         dev,
+		sessionKeys: make(map[string][]byte),
 	}
 
 	return nw, nil
@@ -70,6 +108,11 @@ func (nw *network) Run(ctx context.Context) {
 			nw.handleSubnetEvents(evtBatch)
 
 		case <-ctx.Done():
+			if nw.encrypt {
+				// 进程退出前把本端维护的IPsec SA/SP全部拆除，避免残留加密规则
+				// 导致下次启动时状态和内存表不一致
+				nw.cleanupEncryption()
+			}
 			return
 		}
 	}
@@ -81,6 +124,15 @@ func (nw *network) MTU() int {
 
 type vxlanLeaseAttrs struct {
 	VtepMAC hardwareAddr
+	// VtepMAC6是这台主机vxlan设备在v6栈下的VTEP mac地址，dual-stack集群中v4和
+	// v6共用同一个vxlan设备，因此v4和v6的VTEP mac实际相同，这里单独存一份只是
+	// 为了在lease attrs JSON里显式区分v4/v6，方便只启用了一种协议栈的场景判空
+	VtepMAC6 hardwareAddr `json:",omitempty"`
+	// PublicKey是这台主机的Curve25519公钥，只有在backend config开启了
+	// Encrypt的时候才会被填充。[]byte类型的字段被encoding/json按base64编码，
+	// 所以这里不需要额外的辅助类型。本端收到其他节点公布的PublicKey后，和
+	// 自己的privateKey做ECDH，推导出两端共享的IPsec会话密钥。
+	PublicKey []byte `json:",omitempty"`
 }
 
 func (nw *network) handleSubnetEvents(batch []subnet.Event) {
@@ -202,5 +254,213 @@ func (nw *network) handleSubnetEvents(batch []subnet.Event) {
 		default:
 			log.Error("internal error: unknown event type: ", int(event.Type))
 		}
+
+		// Encrypt：为本端和对端之间的vxlan流量建立一对IPsec transport-mode
+		// SA/SP，对ESP-in-UDP（dport 4789）流量做透明加密。只在backend config
+		// 开启了Encrypt，并且对端也公布了PublicKey的时候才生效。
+		if nw.encrypt && len(vxlanAttrs.PublicKey) > 0 {
+			nw.handleEncryption(event, attrs.PublicIP.ToIP(), vxlanAttrs.PublicKey)
+		}
+
+		// dual-stack：只有本机自己打开了EnableIPv6、并且对端也公布了v6的VTEP mac
+		// 时才进行v6侧的编程。两个条件缺一不可：前者保证v4-only的单栈节点收到
+		// dual-stack对端的lease时不会凭空编程出v6状态，后者保证关闭了EnableIPv6
+		// 的对端（lease的v6侧为空）同样会被跳过。
+		if !nw.enableIPv6 || len(vxlanAttrs.VtepMAC6) == 0 {
+			continue
+		}
+		sn6 := event.Lease.Subnet6
+
+		vxlanRoute6 := netlink.Route{
+			LinkIndex: nw.dev.link.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       sn6.ToIPNet(),
+			Gw:        sn6.IP.ToIP(),
+		}
+		vxlanRoute6.SetFlag(syscall.RTNH_F_ONLINK)
+
+		directRoute6 := netlink.Route{
+			Dst: sn6.ToIPNet(),
+			Gw:  attrs.PublicIPv6.ToIP(),
+		}
+		directRoutingOK6 := false
+		if nw.dev.directRouting {
+			routes, err := netlink.RouteGet(attrs.PublicIPv6.ToIP())
+			if err != nil {
+				log.Errorf("Couldn't lookup v6 route to %v: %v", attrs.PublicIPv6, err)
+			} else if len(routes) == 1 && routes[0].Gw == nil {
+				directRoutingOK6 = true
+			}
+		}
+
+		// v6下没有ARP，neighbor表项的对应物是NDP，通过netlink.NeighAdd加上
+		// FAMILY_V6和NUD_PERMANENT直接写入一条静态的neighbor cache entry
+		neigh6 := &netlink.Neigh{
+			LinkIndex:    nw.dev.link.Attrs().Index,
+			Family:       netlink.FAMILY_V6,
+			State:        neighStateV6,
+			IP:           sn6.IP.ToIP(),
+			HardwareAddr: net.HardwareAddr(vxlanAttrs.VtepMAC6),
+		}
+		// fdb表项记录的是目的主机Public IPv6到其vtep mac的映射，和v4的FDB语义相同
+		fdb6 := &netlink.Neigh{
+			LinkIndex:    nw.dev.link.Attrs().Index,
+			Family:       netlink.FAMILY_V6,
+			Flags:        netlink.NTF_SELF,
+			State:        neighStateV6,
+			IP:           attrs.PublicIPv6.ToIP(),
+			HardwareAddr: net.HardwareAddr(vxlanAttrs.VtepMAC6),
+		}
+
+		switch event.Type {
+		case subnet.EventAdded:
+			if directRoutingOK6 {
+				log.V(2).Infof("Adding direct v6 route to subnet: %s PublicIPv6: %s", sn6, attrs.PublicIPv6)
+				if err := netlink.RouteReplace(&directRoute6); err != nil {
+					log.Errorf("Error adding v6 route to %v via %v: %v", sn6, attrs.PublicIPv6, err)
+					continue
+				}
+			} else {
+				log.V(2).Infof("adding v6 subnet: %s PublicIPv6: %s VtepMAC6: %s", sn6, attrs.PublicIPv6, net.HardwareAddr(vxlanAttrs.VtepMAC6))
+				if err := netlink.NeighAdd(neigh6); err != nil {
+					log.Error("NeighAdd (v6) failed: ", err)
+					continue
+				}
+
+				if err := netlink.NeighAdd(fdb6); err != nil {
+					log.Error("FDB NeighAdd (v6) failed: ", err)
+					if err := netlink.NeighDel(neigh6); err != nil {
+						log.Error("NeighDel (v6) failed: ", err)
+					}
+					continue
+				}
+
+				if err := netlink.RouteReplace(&vxlanRoute6); err != nil {
+					log.Errorf("failed to add v6 vxlanRoute (%s -> %s): %v", vxlanRoute6.Dst, vxlanRoute6.Gw, err)
+					if err := netlink.NeighDel(neigh6); err != nil {
+						log.Error("NeighDel (v6) failed: ", err)
+					}
+					if err := netlink.NeighDel(fdb6); err != nil {
+						log.Error("FDB NeighDel (v6) failed: ", err)
+					}
+					continue
+				}
+			}
+		case subnet.EventRemoved:
+			if directRoutingOK6 {
+				log.V(2).Infof("Removing direct v6 route to subnet: %s PublicIPv6: %s", sn6, attrs.PublicIPv6)
+				if err := netlink.RouteDel(&directRoute6); err != nil {
+					log.Errorf("Error deleting v6 route to %v via %v: %v", sn6, attrs.PublicIPv6, err)
+				}
+			} else {
+				log.V(2).Infof("removing v6 subnet: %s PublicIPv6: %s VtepMAC6: %s", sn6, attrs.PublicIPv6, net.HardwareAddr(vxlanAttrs.VtepMAC6))
+
+				if err := netlink.NeighDel(neigh6); err != nil {
+					log.Error("NeighDel (v6) failed: ", err)
+				}
+
+				if err := netlink.NeighDel(fdb6); err != nil {
+					log.Error("FDB NeighDel (v6) failed: ", err)
+				}
+
+				if err := netlink.RouteDel(&vxlanRoute6); err != nil {
+					log.Errorf("failed to delete v6 vxlanRoute (%s -> %s): %v", vxlanRoute6.Dst, vxlanRoute6.Gw, err)
+				}
+			}
+		default:
+			log.Error("internal error: unknown event type: ", int(event.Type))
+		}
+	}
+}
+
+// handleEncryption为remotePublicIP这个对端节点建立或者拆除一对IPsec SA/SP，
+// localPublicIP是本端节点的Public IP，remoteKey是对端通过lease公布的
+// Curve25519公钥。当remoteKey和上一次记录的不一致（密钥轮转）时，会先删除
+// 旧的SA/SP再安装新的，保证任意时刻只有一套SA生效。
+func (nw *network) handleEncryption(event subnet.Event, remotePublicIP net.IP, remoteKey []byte) {
+	keyID := remotePublicIP.String()
+
+	switch event.Type {
+	case subnet.EventAdded:
+		sessionKey, err := nw.deriveSessionKey(remoteKey)
+		if err != nil {
+			log.Errorf("Failed to derive IPsec session key for %s: %v", remotePublicIP, err)
+			return
+		}
+		if old, ok := nw.sessionKeys[keyID]; ok {
+			if bytesEqual(old, sessionKey) {
+				// 密钥没有变化，无需重新安装SA
+				return
+			}
+			// 密钥发生了轮转，先把旧的SA/SP拆掉，再安装新的，保证某一时刻只有
+			// 一套SA对这个对端生效
+			if err := xfrm.RemoveEncryption(xfrm.State{
+				Src: nw.extIface.ExtAddr, Dst: remotePublicIP, Key: old,
+			}); err != nil {
+				log.Errorf("Failed to remove stale IPsec state for %s: %v", remotePublicIP, err)
+			}
+		}
+		if err := xfrm.AddEncryption(xfrm.State{
+			Src: nw.extIface.ExtAddr, Dst: remotePublicIP, Key: sessionKey,
+		}); err != nil {
+			log.Errorf("Failed to add IPsec state for %s: %v", remotePublicIP, err)
+			return
+		}
+		nw.sessionKeys[keyID] = sessionKey
+	case subnet.EventRemoved:
+		sessionKey, ok := nw.sessionKeys[keyID]
+		if !ok {
+			return
+		}
+		if err := xfrm.RemoveEncryption(xfrm.State{
+			Src: nw.extIface.ExtAddr, Dst: remotePublicIP, Key: sessionKey,
+		}); err != nil {
+			log.Errorf("Failed to remove IPsec state for %s: %v", remotePublicIP, err)
+		}
+		delete(nw.sessionKeys, keyID)
+	}
+}
+
+// deriveSessionKey用本端的privateKey和对端公布的remoteKey做Curve25519 ECDH，
+// 推导出两端共享的IPsec会话密钥
+func (nw *network) deriveSessionKey(remoteKey []byte) ([]byte, error) {
+	if len(remoteKey) != 32 {
+		return nil, fmt.Errorf("invalid remote public key length %d", len(remoteKey))
+	}
+	var remote [32]byte
+	copy(remote[:], remoteKey)
+	shared, err := curve25519.X25519(nw.privateKey[:], remote[:])
+	if err != nil {
+		return nil, err
+	}
+	return shared, nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanupEncryption在backend关闭（ctx被取消）的时候调用，把这个network当前
+// 维护的全部IPsec SA/SP都拆除掉，避免进程退出后遗留下无人维护的加密规则
+func (nw *network) cleanupEncryption() {
+	for keyID, sessionKey := range nw.sessionKeys {
+		remotePublicIP := net.ParseIP(keyID)
+		if remotePublicIP == nil {
+			continue
+		}
+		if err := xfrm.RemoveEncryption(xfrm.State{
+			Src: nw.extIface.ExtAddr, Dst: remotePublicIP, Key: sessionKey,
+		}); err != nil {
+			log.Errorf("Failed to remove IPsec state for %s during shutdown: %v", remotePublicIP, err)
+		}
+		delete(nw.sessionKeys, keyID)
 	}
 }